@@ -0,0 +1,80 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package resourcemodel lets callers teach schedulercache.Resource how to
+// fold a resource.Quantity into and out of its int64 accumulators, instead
+// of schedulercache hardcoding a switch case per resource name. Built-in
+// resources register themselves below; an out-of-tree extension (RDMA,
+// a vendor scalar, a new hugepage size) registers its own Handler from an
+// init() and schedulercache never needs to change.
+package resourcemodel
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Handler adapts a single resource name's int64 accumulator to and from
+// the API's resource.Quantity.
+type Handler struct {
+	// Add folds quantity into acc and returns the new accumulated value.
+	Add func(acc int64, quantity resource.Quantity) int64
+	// Format turns an accumulated value back into a resource.Quantity,
+	// e.g. for Resource.ResourceList().
+	Format func(acc int64) resource.Quantity
+}
+
+var handlers = map[v1.ResourceName]Handler{}
+
+// Register adds (or replaces) the Handler used for name. Call it from an
+// init() in the package that owns the resource, before any Resource is
+// built from a ResourceList that can contain it.
+func Register(name v1.ResourceName, handler Handler) {
+	handlers[name] = handler
+}
+
+// Lookup returns the Handler registered for name, if any.
+func Lookup(name v1.ResourceName) (Handler, bool) {
+	h, ok := handlers[name]
+	return h, ok
+}
+
+func decimalHandler() Handler {
+	return Handler{
+		Add:    func(acc int64, q resource.Quantity) int64 { return acc + q.Value() },
+		Format: func(acc int64) resource.Quantity { return *resource.NewQuantity(acc, resource.DecimalSI) },
+	}
+}
+
+func binaryHandler() Handler {
+	h := decimalHandler()
+	h.Format = func(acc int64) resource.Quantity { return *resource.NewQuantity(acc, resource.BinarySI) }
+	return h
+}
+
+func init() {
+	// MilliCPU and Memory keep dedicated fast-path fields on Resource for
+	// hot code, but they still register here so callers that only know a
+	// resource by name (e.g. a generic reservation path) can still fold
+	// them the same way as any other resource.
+	Register(v1.ResourceCPU, Handler{
+		Add:    func(acc int64, q resource.Quantity) int64 { return acc + q.MilliValue() },
+		Format: func(acc int64) resource.Quantity { return *resource.NewMilliQuantity(acc, resource.DecimalSI) },
+	})
+	Register(v1.ResourceMemory, binaryHandler())
+	Register(v1.ResourceNvidiaGPU, decimalHandler())
+	Register(v1.ResourceEphemeralStorage, binaryHandler())
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"k8s.io/api/core/v1"
+)
+
+const (
+	// ResourceGPUMemory is the fractional GPU memory, in MiB, a pod may
+	// request from a single device instead of a whole nvidia.com/gpu.
+	ResourceGPUMemory v1.ResourceName = "nvidia.com/gpu-memory"
+	// ResourceGPUCores is the fractional GPU compute a pod may request
+	// from a single device, out of 1000 millicores per whole device.
+	ResourceGPUCores v1.ResourceName = "nvidia.com/gpu-cores"
+
+	// DeviceAssignmentAnnotation records the device IDs a Reserve plugin
+	// picked for a pod's GPU request, so that DeviceInfo.Used* can be
+	// reconstructed from the pod list alone after a scheduler restart,
+	// without re-running Reserve.
+	DeviceAssignmentAnnotation = "scheduler.alpha.kubernetes.io/device-assignment"
+)
+
+// DeviceInfo tracks a single GPU (or other accelerator card)'s capacity
+// and current fractional usage, so a node's GPUs can be shared by more
+// than one pod instead of being handed out as a single opaque scalar.
+type DeviceInfo struct {
+	// UUID is the device's stable identifier, e.g. as reported by nvidia-smi.
+	UUID string
+	// Index gives devices on a node a stable ordering for allocation.
+	Index int
+
+	CoresCapacity  int64
+	MemoryCapacity int64
+	UsedCores      int64
+	UsedMemory     int64
+
+	// NUMANode is the NUMA node this device is attached to, or -1 if unknown.
+	NUMANode int
+	Healthy  bool
+}
+
+func (d *DeviceInfo) coresFree() int64  { return d.CoresCapacity - d.UsedCores }
+func (d *DeviceInfo) memoryFree() int64 { return d.MemoryCapacity - d.UsedMemory }
+
+// Clone returns a deep copy of d.
+func (d *DeviceInfo) Clone() *DeviceInfo {
+	clone := *d
+	return &clone
+}
+
+// DeviceFraction is the slice of a single device a pod is requesting or
+// has been allocated.
+type DeviceFraction struct {
+	Cores  int64
+	Memory int64
+}
+
+// deviceAllocation is what a single pod consumed from a single device,
+// recorded so ReleaseDevice can reverse exactly what AllocateDevice (or
+// assignment restore on warm-up) credited.
+type deviceAllocation struct {
+	DeviceID string `json:"deviceID"`
+	Cores    int64  `json:"cores"`
+	Memory   int64  `json:"memory"`
+}
+
+// Devices returns the node's devices ordered by Index.
+func (n *NodeInfo) Devices() []*DeviceInfo {
+	if n == nil {
+		return nil
+	}
+	result := make([]*DeviceInfo, 0, len(n.devices))
+	for _, d := range n.devices {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Index < result[j].Index })
+	return result
+}
+
+// SetDevices replaces the node's device inventory, e.g. when populating
+// NodeInfo from the node's device-plugin status.
+func (n *NodeInfo) SetDevices(devices []*DeviceInfo) {
+	n.devices = make(map[string]*DeviceInfo, len(devices))
+	for _, d := range devices {
+		n.devices[d.UUID] = d
+	}
+	n.generation++
+}
+
+// ChooseDevices picks device IDs on the node that can satisfy a pod's
+// GPU request. A request for wholeGPUs picks that many devices with zero
+// prior use; a fractional request best-fits onto the healthy device with
+// the least headroom, in whichever of cores/memory the request actually
+// asks for, that still satisfies it, to reduce fragmentation. Devices are
+// considered in stable Index order so repeat calls against unchanged
+// state are deterministic.
+func (n *NodeInfo) ChooseDevices(wholeGPUs int, frac DeviceFraction) ([]string, error) {
+	devices := n.Devices()
+
+	if wholeGPUs > 0 {
+		chosen := make([]string, 0, wholeGPUs)
+		for _, d := range devices {
+			if d.Healthy && d.UsedCores == 0 && d.UsedMemory == 0 {
+				chosen = append(chosen, d.UUID)
+				if len(chosen) == wholeGPUs {
+					return chosen, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("node %v does not have %d unused devices available", n.node.Name, wholeGPUs)
+	}
+
+	var best *DeviceInfo
+	var bestHeadroom int64
+	for _, d := range devices {
+		if !d.Healthy || d.coresFree() < frac.Cores || d.memoryFree() < frac.Memory {
+			continue
+		}
+		// Rank by headroom in whichever dimension(s) the request actually
+		// asks for, so a memory-only fractional request (Cores == 0) best-
+		// fits on memory instead of being ranked by an unrequested cores
+		// headroom.
+		var headroom int64
+		if frac.Cores > 0 {
+			headroom += d.coresFree()
+		}
+		if frac.Memory > 0 {
+			headroom += d.memoryFree()
+		}
+		if best == nil || headroom < bestHeadroom {
+			best = d
+			bestHeadroom = headroom
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("node %v has no device with enough headroom for %+v", n.node.Name, frac)
+	}
+	return []string{best.UUID}, nil
+}
+
+// AllocateDevice debits frac from deviceID and remembers the debit against
+// pod's key so RemovePod/ReleaseDevice can reverse exactly this amount.
+// A scheduler extender calls this from Reserve once it has picked the
+// device IDs, typically via ChooseDevices.
+func (n *NodeInfo) AllocateDevice(pod *v1.Pod, deviceID string, frac DeviceFraction) error {
+	d, ok := n.devices[deviceID]
+	if !ok {
+		return fmt.Errorf("device %v not found on node %v", deviceID, n.node.Name)
+	}
+	if frac.Cores > d.coresFree() || frac.Memory > d.memoryFree() {
+		return fmt.Errorf("device %v does not have enough headroom for pod %v", deviceID, pod.Name)
+	}
+
+	key, err := getPodKey(pod)
+	if err != nil {
+		return err
+	}
+
+	d.UsedCores += frac.Cores
+	d.UsedMemory += frac.Memory
+	n.podDevices[key] = append(n.podDevices[key], deviceAllocation{DeviceID: deviceID, Cores: frac.Cores, Memory: frac.Memory})
+	n.generation++
+	return nil
+}
+
+// ReleaseDevice reverses every AllocateDevice call made for pod.
+func (n *NodeInfo) ReleaseDevice(pod *v1.Pod) error {
+	key, err := getPodKey(pod)
+	if err != nil {
+		return err
+	}
+	n.releaseDeviceByKey(key)
+	return nil
+}
+
+func (n *NodeInfo) releaseDeviceByKey(key string) {
+	allocations, ok := n.podDevices[key]
+	if !ok {
+		return
+	}
+	for _, a := range allocations {
+		if d, ok := n.devices[a.DeviceID]; ok {
+			d.UsedCores -= a.Cores
+			d.UsedMemory -= a.Memory
+		}
+	}
+	delete(n.podDevices, key)
+	n.generation++
+}
+
+// restoreDeviceAssignment reconstructs DeviceInfo.Used* for a pod being
+// re-added to a freshly rebuilt NodeInfo (e.g. after a scheduler
+// restart), using the device-assignment annotation a Reserve plugin
+// previously wrote. Unlike AllocateDevice it doesn't check capacity: a
+// debit that exceeds a device's free cores or memory is applied anyway.
+// A device the annotation names but the node doesn't have is logged and
+// skipped, while the pod's recorded allocation still lists it. It's a no-op if
+// n.podDevices already has a record for this pod, since that means
+// AllocateDevice already debited this NodeInfo for it and restoring on
+// top would double-debit the devices.
+func (n *NodeInfo) restoreDeviceAssignment(pod *v1.Pod) {
+	allocations, ok := decodeDeviceAssignment(pod)
+	if !ok {
+		return
+	}
+
+	key, err := getPodKey(pod)
+	if err != nil {
+		return
+	}
+	if _, ok := n.podDevices[key]; ok {
+		return
+	}
+
+	for _, a := range allocations {
+		d, ok := n.devices[a.DeviceID]
+		if !ok {
+			glog.Errorf("device %v referenced by pod %v not found on node %v during warm-up", a.DeviceID, pod.Name, pod.Spec.NodeName)
+			continue
+		}
+		d.UsedCores += a.Cores
+		d.UsedMemory += a.Memory
+	}
+	n.podDevices[key] = allocations
+}
+
+func decodeDeviceAssignment(pod *v1.Pod) ([]deviceAllocation, bool) {
+	raw, ok := pod.Annotations[DeviceAssignmentAnnotation]
+	if !ok {
+		return nil, false
+	}
+	var allocations []deviceAllocation
+	if err := json.Unmarshal([]byte(raw), &allocations); err != nil {
+		glog.Errorf("failed to decode device assignment for pod %v: %v", pod.Name, err)
+		return nil, false
+	}
+	return allocations, true
+}
+
+// EncodeDeviceAssignment serializes the chosen device IDs and fractions
+// so a Reserve plugin can stamp them onto the pod's annotations.
+func EncodeDeviceAssignment(assignment []DeviceFraction, deviceIDs []string) (string, error) {
+	allocations := make([]deviceAllocation, 0, len(deviceIDs))
+	for i, id := range deviceIDs {
+		allocations = append(allocations, deviceAllocation{DeviceID: id, Cores: assignment[i].Cores, Memory: assignment[i].Memory})
+	}
+	raw, err := json.Marshal(allocations)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
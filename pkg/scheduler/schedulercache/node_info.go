@@ -23,9 +23,11 @@ import (
 
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
 	clientcache "k8s.io/client-go/tools/cache"
 	v1helper "k8s.io/kubernetes/pkg/apis/core/v1/helper"
 	priorityutil "k8s.io/kubernetes/pkg/scheduler/algorithm/priorities/util"
+	"k8s.io/kubernetes/pkg/scheduler/resourcemodel"
 	"k8s.io/kubernetes/pkg/scheduler/util"
 )
 
@@ -63,6 +65,35 @@ type NodeInfo struct {
 
 	reservedResource     *Resource
 	resourceReservations ResourceReservationList
+
+	// devices is the node's GPU (or other accelerator) inventory, keyed
+	// by device UUID. podDevices records, per pod key, the fractions
+	// debited from each device, so RemovePod reverses exactly what
+	// AddPod/AllocateDevice allocated.
+	devices    map[string]*DeviceInfo
+	podDevices map[string][]deviceAllocation
+
+	// requestedResource broken down by the pod's native QoS class, plus
+	// a reclaimable tier for pods that only request reclaimed-cpu/
+	// reclaimed-memory, so predicates can enforce per-tier overcommit
+	// ratios instead of one blanket allocatable.
+	requestedResourceByQoS       map[v1.PodQOSClass]*Resource
+	reclaimableRequestedResource *Resource
+
+	// numaNodes is the node's per-socket topology; podTopologyHints
+	// records, per pod UID, the NUMA node and exclusive cpuset a
+	// CPUAccumulator-backed Reserve plugin picked for it, so
+	// RemovePodWithTopologyHint can reverse exactly that allocation.
+	numaNodes        []NUMANodeResource
+	podTopologyHints map[types.UID]TopologyHint
+
+	// reservations holds the first-class Reservation objects (see
+	// reservation.go) carved out of this node, keyed by "namespace/name".
+	// podReservations records, per pod key, which reservation a pod's
+	// request was matched and debited against, so RemovePod can reverse
+	// exactly that debit.
+	reservations    map[string]*Reservation
+	podReservations map[string]string
 }
 
 type ResourceReservationList map[string]*ResourceReservation
@@ -97,70 +128,27 @@ func (rr *ResourceReservation) ReservedResource() Resource {
 	return *rr.reservedResource
 }
 
+// addPod accounts pod's reservation request into the reservation's
+// Reserved total. Reserved is tracked as an explicit sum of the
+// per-pod shares rather than a max, since a reservation can be shared
+// by multiple co-scheduled pods (e.g. a StatefulSet's replicas) and a
+// max silently under-counts capacity once more than one pod is present.
 func (rr *ResourceReservation) addPod(pod *v1.Pod) {
-	r := rr.reservedResource
-	rl := pod.Spec.ResourceReservation.Resources.Requests
-
-	rr.perPodReservation[pod.Name] = NewResource(pod.Spec.ResourceReservation.Resources.Requests)
-
-	for rName, rQuant := range rl {
-		switch rName {
-		case v1.ResourceCPU:
-			if r.MilliCPU < rQuant.MilliValue() {
-				r.MilliCPU = rQuant.MilliValue()
-			}
-		case v1.ResourceMemory:
-			if r.Memory < rQuant.Value() {
-				r.Memory = rQuant.Value()
-			}
-		default:
-			glog.Errorf("resource reservation for %v is not supported.", rName)
-			continue
-		}
-	}
+	share := NewResource(pod.Spec.ResourceReservation.Resources.Requests)
+	rr.perPodReservation[pod.Name] = share
+	rr.reservedResource.AddResource(share)
 }
 
+// removePod reverses exactly the share addPod credited for pod, rather
+// than recomputing a max across the remaining pods.
 func (rr *ResourceReservation) removePod(pod *v1.Pod) {
-	r := rr.reservedResource
-	rl := pod.Spec.ResourceReservation.Resources.Requests
-
-	delete(rr.perPodReservation, pod.Name)
-
-	for rName, rQuant := range rl {
-		switch rName {
-		case v1.ResourceCPU:
-			if r.MilliCPU > rQuant.MilliValue() {
-				glog.Errorf("resource reservation corrupted: %v %v", rr, pod)
-			}
-			if r.MilliCPU == rQuant.MilliValue() {
-				var max int64
-				max = 0
-				for _, v := range rr.perPodReservation {
-					if v.MilliCPU > max {
-						max = v.MilliCPU
-					}
-				}
-				r.MilliCPU = max
-			}
-		case v1.ResourceMemory:
-			if r.Memory > rQuant.Value() {
-				glog.Errorf("resource reservation corrupted: %v %v", rr, pod)
-			}
-			if r.Memory == rQuant.Value() {
-				var max int64
-				max = 0
-				for _, v := range rr.perPodReservation {
-					if v.Memory > max {
-						max = v.Memory
-					}
-				}
-				r.Memory = max
-			}
-		default:
-			glog.Errorf("resource reservation for %v is not supported.", rName)
-			continue
-		}
+	share, ok := rr.perPodReservation[pod.Name]
+	if !ok {
+		glog.Errorf("resource reservation corrupted: pod %v not found in %v", pod.Name, rr)
+		return
 	}
+	delete(rr.perPodReservation, pod.Name)
+	rr.reservedResource.RemoveResource(share)
 }
 
 func (rr *ResourceReservation) String() string {
@@ -188,14 +176,17 @@ func (rr *ResourceReservation) Clone() *ResourceReservation {
 
 // Resource is a collection of compute resource.
 type Resource struct {
-	MilliCPU         int64
-	Memory           int64
-	NvidiaGPU        int64
-	EphemeralStorage int64
+	MilliCPU int64
+	Memory   int64
 	// We store allowedPodNumber (which is Node.Status.Allocatable.Pods().Value())
 	// explicitly as int, to avoid conversions and improve performance.
 	AllowedPodNumber int
-	// ScalarResources
+	// ScalarResources holds every resource other than MilliCPU/Memory,
+	// keyed by name: NvidiaGPU, EphemeralStorage, hugepages, device
+	// plugin and vendor scalars alike. A resource folds in here through
+	// its resourcemodel.Handler if one is registered, or falls back to
+	// the generic v1helper.IsScalarResourceName path otherwise, so this
+	// type never needs a dedicated field or switch case added for it.
 	ScalarResources map[v1.ResourceName]int64
 }
 
@@ -218,40 +209,49 @@ func (r *Resource) Add(rl v1.ResourceList) {
 			r.MilliCPU += rQuant.MilliValue()
 		case v1.ResourceMemory:
 			r.Memory += rQuant.Value()
-		case v1.ResourceNvidiaGPU:
-			r.NvidiaGPU += rQuant.Value()
 		case v1.ResourcePods:
 			r.AllowedPodNumber += int(rQuant.Value())
-		case v1.ResourceEphemeralStorage:
-			r.EphemeralStorage += rQuant.Value()
 		default:
-			if v1helper.IsScalarResourceName(rName) {
+			if handler, ok := resourcemodel.Lookup(rName); ok {
+				r.SetScalar(rName, handler.Add(r.ScalarResources[rName], rQuant))
+			} else if v1helper.IsScalarResourceName(rName) {
 				r.AddScalar(rName, rQuant.Value())
 			}
 		}
 	}
 }
 
-// only for reservation
+// AddResource folds x into r: the MilliCPU/Memory fast path plus every
+// resource x carries in ScalarResources (GPU, hugepages, whatever's
+// registered), so a reservation can cover arbitrary resources without
+// this function knowing their names. Used only on the reservation path.
 func (r *Resource) AddResource(x *Resource) {
 	r.MilliCPU += x.MilliCPU
 	r.Memory += x.Memory
+	for rName, rQuant := range x.ScalarResources {
+		r.AddScalar(rName, rQuant)
+	}
 }
+
+// RemoveResource reverses AddResource.
 func (r *Resource) RemoveResource(x *Resource) {
 	r.MilliCPU -= x.MilliCPU
 	r.Memory -= x.Memory
+	for rName, rQuant := range x.ScalarResources {
+		r.AddScalar(rName, -rQuant)
+	}
 }
 
 func (r *Resource) ResourceList() v1.ResourceList {
 	result := v1.ResourceList{
-		v1.ResourceCPU:              *resource.NewMilliQuantity(r.MilliCPU, resource.DecimalSI),
-		v1.ResourceMemory:           *resource.NewQuantity(r.Memory, resource.BinarySI),
-		v1.ResourceNvidiaGPU:        *resource.NewQuantity(r.NvidiaGPU, resource.DecimalSI),
-		v1.ResourcePods:             *resource.NewQuantity(int64(r.AllowedPodNumber), resource.BinarySI),
-		v1.ResourceEphemeralStorage: *resource.NewQuantity(r.EphemeralStorage, resource.BinarySI),
+		v1.ResourceCPU:    *resource.NewMilliQuantity(r.MilliCPU, resource.DecimalSI),
+		v1.ResourceMemory: *resource.NewQuantity(r.Memory, resource.BinarySI),
+		v1.ResourcePods:   *resource.NewQuantity(int64(r.AllowedPodNumber), resource.BinarySI),
 	}
 	for rName, rQuant := range r.ScalarResources {
-		if v1helper.IsHugePageResourceName(rName) {
+		if handler, ok := resourcemodel.Lookup(rName); ok {
+			result[rName] = handler.Format(rQuant)
+		} else if v1helper.IsHugePageResourceName(rName) {
 			result[rName] = *resource.NewQuantity(rQuant, resource.BinarySI)
 		} else {
 			result[rName] = *resource.NewQuantity(rQuant, resource.DecimalSI)
@@ -264,9 +264,7 @@ func (r *Resource) Clone() *Resource {
 	res := &Resource{
 		MilliCPU:         r.MilliCPU,
 		Memory:           r.Memory,
-		NvidiaGPU:        r.NvidiaGPU,
 		AllowedPodNumber: r.AllowedPodNumber,
-		EphemeralStorage: r.EphemeralStorage,
 	}
 	if r.ScalarResources != nil {
 		res.ScalarResources = make(map[v1.ResourceName]int64)
@@ -294,13 +292,20 @@ func (r *Resource) SetScalar(name v1.ResourceName, quantity int64) {
 // the returned object.
 func NewNodeInfo(pods ...*v1.Pod) *NodeInfo {
 	ni := &NodeInfo{
-		requestedResource:    &Resource{},
-		nonzeroRequest:       &Resource{},
-		allocatableResource:  &Resource{},
-		generation:           0,
-		usedPorts:            make(util.HostPortInfo),
-		reservedResource:     &Resource{},
-		resourceReservations: make(ResourceReservationList),
+		requestedResource:            &Resource{},
+		nonzeroRequest:               &Resource{},
+		allocatableResource:          &Resource{},
+		generation:                   0,
+		usedPorts:                    make(util.HostPortInfo),
+		reservedResource:             &Resource{},
+		resourceReservations:         make(ResourceReservationList),
+		devices:                      make(map[string]*DeviceInfo),
+		podDevices:                   make(map[string][]deviceAllocation),
+		requestedResourceByQoS:       make(map[v1.PodQOSClass]*Resource),
+		reclaimableRequestedResource: &Resource{},
+		podTopologyHints:             make(map[types.UID]TopologyHint),
+		reservations:                 make(map[string]*Reservation),
+		podReservations:              make(map[string]string),
 	}
 	for _, pod := range pods {
 		ni.AddPod(pod)
@@ -438,6 +443,37 @@ func (n *NodeInfo) Clone() *NodeInfo {
 	for k, v := range n.resourceReservations {
 		clone.resourceReservations[k] = v.Clone()
 	}
+	clone.devices = make(map[string]*DeviceInfo, len(n.devices))
+	for k, v := range n.devices {
+		clone.devices[k] = v.Clone()
+	}
+	clone.podDevices = make(map[string][]deviceAllocation, len(n.podDevices))
+	for k, v := range n.podDevices {
+		clone.podDevices[k] = append([]deviceAllocation(nil), v...)
+	}
+	clone.requestedResourceByQoS = make(map[v1.PodQOSClass]*Resource, len(n.requestedResourceByQoS))
+	for k, v := range n.requestedResourceByQoS {
+		clone.requestedResourceByQoS[k] = v.Clone()
+	}
+	clone.reclaimableRequestedResource = n.reclaimableRequestedResource.Clone()
+	if len(n.numaNodes) > 0 {
+		clone.numaNodes = make([]NUMANodeResource, len(n.numaNodes))
+		for i := range n.numaNodes {
+			clone.numaNodes[i] = n.numaNodes[i].clone()
+		}
+	}
+	clone.podTopologyHints = make(map[types.UID]TopologyHint, len(n.podTopologyHints))
+	for k, v := range n.podTopologyHints {
+		clone.podTopologyHints[k] = TopologyHint{NUMAID: v.NUMAID, CPUs: append([]int(nil), v.CPUs...)}
+	}
+	clone.reservations = make(map[string]*Reservation, len(n.reservations))
+	for k, v := range n.reservations {
+		clone.reservations[k] = v.Clone()
+	}
+	clone.podReservations = make(map[string]string, len(n.podReservations))
+	for k, v := range n.podReservations {
+		clone.podReservations[k] = v
+	}
 	return clone
 }
 
@@ -482,7 +518,14 @@ func (n *NodeInfo) removeReservation(name string, pod *v1.Pod) *ResourceReservat
 			n.reservedResource.RemoveResource(reservation.reservedResource)
 			return nil
 		}
+		// Mirror the remove/add dance updateReservation does: back out
+		// the reservation's old total before removePod shrinks its share,
+		// then add the new total back, instead of leaving the pod's share
+		// counted in n.reservedResource after it was already dropped from
+		// reservation.reservedResource.
+		n.reservedResource.RemoveResource(reservation.reservedResource)
 		reservation.removePod(pod)
+		n.reservedResource.AddResource(reservation.reservedResource)
 		return reservation
 	} else {
 		glog.Errorf("reservation(%v) is not found.", name)
@@ -500,26 +543,34 @@ func (n *NodeInfo) AddPod(pod *v1.Pod) {
 	}
 
 	res, non0_cpu, non0_mem := calculateResource(pod)
+
+	// If pod matches a first-class Reservation carved out of this node
+	// and fits its remaining capacity, debit its request from that
+	// reservation's Allocated instead of the node's general
+	// requestedResource, so it's not counted against both.
+	consumedReservation := n.consumeReservation(pod, res)
+
 	if reservedcpu {
 		reservation.usedResource.MilliCPU += res.MilliCPU
-	} else {
+	} else if !consumedReservation {
 		n.requestedResource.MilliCPU += res.MilliCPU
 	}
 	if reservedmem {
 		reservation.usedResource.Memory += res.Memory
-	} else {
+	} else if !consumedReservation {
 		n.requestedResource.Memory += res.Memory
 	}
-	n.requestedResource.NvidiaGPU += res.NvidiaGPU
-	n.requestedResource.EphemeralStorage += res.EphemeralStorage
-	if n.requestedResource.ScalarResources == nil && len(res.ScalarResources) > 0 {
-		n.requestedResource.ScalarResources = map[v1.ResourceName]int64{}
-	}
-	for rName, rQuant := range res.ScalarResources {
-		n.requestedResource.ScalarResources[rName] += rQuant
+	if !consumedReservation {
+		if n.requestedResource.ScalarResources == nil && len(res.ScalarResources) > 0 {
+			n.requestedResource.ScalarResources = map[v1.ResourceName]int64{}
+		}
+		for rName, rQuant := range res.ScalarResources {
+			n.requestedResource.ScalarResources[rName] += rQuant
+		}
 	}
 	n.nonzeroRequest.MilliCPU += non0_cpu
 	n.nonzeroRequest.Memory += non0_mem
+	n.addToQoS(pod, res)
 	n.pods = append(n.pods, pod)
 	if hasPodAffinityConstraints(pod) {
 		n.podsWithAffinity = append(n.podsWithAffinity, pod)
@@ -528,6 +579,12 @@ func (n *NodeInfo) AddPod(pod *v1.Pod) {
 	// Consume ports when pods added.
 	n.updateUsedPorts(pod, true)
 
+	// A pod that already carries a device-assignment annotation was
+	// scheduled in a prior scheduler run; reconstruct DeviceInfo.Used*
+	// from it instead of waiting for a Reserve plugin to call
+	// AllocateDevice again.
+	n.restoreDeviceAssignment(pod)
+
 	n.generation++
 }
 
@@ -571,33 +628,53 @@ func (n *NodeInfo) RemovePod(pod *v1.Pod) error {
 
 			res, non0_cpu, non0_mem := calculateResource(pod)
 
+			// Mirror AddPod: a pod whose request was debited against a
+			// first-class Reservation was never added to
+			// n.requestedResource, so it must not be subtracted from it
+			// either. Check before releaseReservation, which clears the
+			// podReservations record.
+			_, consumedReservation := n.podReservations[k1]
+
 			if reservedcpu {
 				if reservation != nil {
 					reservation.usedResource.MilliCPU -= res.MilliCPU
 				}
-			} else {
+			} else if !consumedReservation {
 				n.requestedResource.MilliCPU -= res.MilliCPU
 			}
 			if reservedmem {
 				if reservation != nil {
-					reservation.usedResource.Memory += res.Memory
+					reservation.usedResource.Memory -= res.Memory
 				}
-			} else {
+			} else if !consumedReservation {
 				n.requestedResource.Memory -= res.Memory
 			}
-			n.requestedResource.NvidiaGPU -= res.NvidiaGPU
-			if len(res.ScalarResources) > 0 && n.requestedResource.ScalarResources == nil {
-				n.requestedResource.ScalarResources = map[v1.ResourceName]int64{}
-			}
-			for rName, rQuant := range res.ScalarResources {
-				n.requestedResource.ScalarResources[rName] -= rQuant
+			if !consumedReservation {
+				if len(res.ScalarResources) > 0 && n.requestedResource.ScalarResources == nil {
+					n.requestedResource.ScalarResources = map[v1.ResourceName]int64{}
+				}
+				for rName, rQuant := range res.ScalarResources {
+					n.requestedResource.ScalarResources[rName] -= rQuant
+				}
 			}
 			n.nonzeroRequest.MilliCPU -= non0_cpu
 			n.nonzeroRequest.Memory -= non0_mem
+			n.subtractFromQoS(pod, res)
 
 			// Release ports when remove Pods.
 			n.updateUsedPorts(pod, false)
 
+			// Release any first-class Reservation share this pod held.
+			n.releaseReservation(k1, res)
+
+			// Release any GPU devices this pod held.
+			n.releaseDeviceByKey(k1)
+
+			// Release any exclusive NUMA/cpuset assignment this pod held.
+			if err := n.RemovePodWithTopologyHint(pod); err != nil {
+				glog.Errorf("failed to release topology hint for pod %v: %v", pod.Name, err)
+			}
+
 			n.generation++
 
 			return nil
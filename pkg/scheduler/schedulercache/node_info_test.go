@@ -0,0 +1,91 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func reservationPod(name string, reservationName string, cpu, mem int64) *v1.Pod {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceCPU:    *resource.NewMilliQuantity(cpu, resource.DecimalSI),
+						v1.ResourceMemory: *resource.NewQuantity(mem, resource.BinarySI),
+					},
+				},
+			}},
+		},
+	}
+	pod.Spec.ResourceReservation.Name = reservationName
+	pod.Spec.ResourceReservation.Resources.Requests = v1.ResourceList{
+		v1.ResourceCPU:    *resource.NewMilliQuantity(cpu, resource.DecimalSI),
+		v1.ResourceMemory: *resource.NewQuantity(mem, resource.BinarySI),
+	}
+	return pod
+}
+
+// TestSharedReservationAddRemoveReturnsToBaseline pins down that
+// n.reservedResource returns to its exact baseline once every pod sharing
+// a reservation has been added and then removed again, and that the
+// ResourceReservation's own reservedResource tracks the remaining pod's
+// share until the last pod is removed, covering both the sum-based
+// addPod/removePod accounting and removeReservation's remove/add dance.
+func TestSharedReservationAddRemoveReturnsToBaseline(t *testing.T) {
+	n := NewNodeInfo()
+	baseline := n.ReservedResource()
+
+	podA := reservationPod("pod-a", "shared", 100, 1<<20)
+	podB := reservationPod("pod-b", "shared", 200, 2<<20)
+
+	n.AddPod(podA)
+	n.AddPod(podB)
+
+	reserved := n.ReservedResource()
+	if reserved.MilliCPU != 300 || reserved.Memory != 3<<20 {
+		t.Fatalf("after adding both pods, ReservedResource = %+v, want {MilliCPU:300 Memory:%d}", reserved, int64(3<<20))
+	}
+
+	if err := n.RemovePod(podA); err != nil {
+		t.Fatalf("RemovePod(podA): %v", err)
+	}
+	reserved = n.ReservedResource()
+	if reserved.MilliCPU != 200 || reserved.Memory != 2<<20 {
+		t.Fatalf("after removing podA, ReservedResource = %+v, want {MilliCPU:200 Memory:%d}", reserved, int64(2<<20))
+	}
+	if rr := n.ResourceReservation("shared"); rr == nil || rr.ReservedResource().MilliCPU != 200 {
+		t.Fatalf("reservation %q ReservedResource after removing podA = %+v, want MilliCPU:200", "shared", rr.ReservedResource())
+	}
+
+	if err := n.RemovePod(podB); err != nil {
+		t.Fatalf("RemovePod(podB): %v", err)
+	}
+	reserved = n.ReservedResource()
+	if reserved.MilliCPU != baseline.MilliCPU || reserved.Memory != baseline.Memory {
+		t.Fatalf("after removing every pod sharing the reservation, ReservedResource = %+v, want baseline %+v", reserved, baseline)
+	}
+	if rr := n.ResourceReservation("shared"); rr != nil {
+		t.Fatalf("reservation %q should have been dropped once its last pod was removed, got %+v", "shared", rr)
+	}
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"fmt"
+	"sort"
+
+	"k8s.io/api/core/v1"
+)
+
+// NUMANodeResource tracks CPU, memory, hugepages, and devices for a
+// single socket/NUMA node, so a node's capacity can be accounted per
+// socket instead of only in aggregate.
+type NUMANodeResource struct {
+	NUMAID int
+
+	MemoryCapacity    int64
+	MemoryUsed        int64
+	HugepagesCapacity map[v1.ResourceName]int64
+	HugepagesUsed     map[v1.ResourceName]int64
+
+	// DeviceUUIDs are the devices (see DeviceInfo) attached to this
+	// socket.
+	DeviceUUIDs []string
+
+	// ThreadsPerCore is the number of SMT sibling logical CPUs sharing a
+	// physical core on this socket.
+	ThreadsPerCore int
+	// CPUToCore maps a logical CPU ID to its physical core ID. It is
+	// fixed topology, not allocation state.
+	CPUToCore map[int]int
+	// FreeCPUs is the set of logical CPU IDs on this socket not
+	// currently exclusively assigned to a pod.
+	FreeCPUs map[int]bool
+}
+
+func (nr *NUMANodeResource) clone() NUMANodeResource {
+	clone := *nr
+	if nr.HugepagesCapacity != nil {
+		clone.HugepagesCapacity = make(map[v1.ResourceName]int64, len(nr.HugepagesCapacity))
+		for k, v := range nr.HugepagesCapacity {
+			clone.HugepagesCapacity[k] = v
+		}
+	}
+	if nr.HugepagesUsed != nil {
+		clone.HugepagesUsed = make(map[v1.ResourceName]int64, len(nr.HugepagesUsed))
+		for k, v := range nr.HugepagesUsed {
+			clone.HugepagesUsed[k] = v
+		}
+	}
+	clone.DeviceUUIDs = append([]string(nil), nr.DeviceUUIDs...)
+	clone.CPUToCore = make(map[int]int, len(nr.CPUToCore))
+	for k, v := range nr.CPUToCore {
+		clone.CPUToCore[k] = v
+	}
+	clone.FreeCPUs = make(map[int]bool, len(nr.FreeCPUs))
+	for k, v := range nr.FreeCPUs {
+		clone.FreeCPUs[k] = v
+	}
+	return clone
+}
+
+// takeExclusiveCPUs picks want logical CPUs from this socket, preferring
+// whole physical cores (all SMT siblings free) before splitting a core
+// between pods, to keep cache-sharing pods off the same exclusive core.
+// It does not mutate nr; the caller applies the result once a NUMA node
+// has been chosen.
+func (nr *NUMANodeResource) takeExclusiveCPUs(want int) ([]int, bool) {
+	if len(nr.FreeCPUs) < want {
+		return nil, false
+	}
+
+	coreFree := map[int][]int{}
+	for cpu := range nr.FreeCPUs {
+		core := nr.CPUToCore[cpu]
+		coreFree[core] = append(coreFree[core], cpu)
+	}
+
+	var fullCores []int
+	for core, cpus := range coreFree {
+		if len(cpus) == nr.ThreadsPerCore {
+			fullCores = append(fullCores, core)
+		}
+	}
+	sort.Ints(fullCores)
+
+	chosen := make(map[int]bool, want)
+	order := make([]int, 0, want)
+	for _, core := range fullCores {
+		if len(order)+len(coreFree[core]) > want {
+			continue
+		}
+		cpus := append([]int(nil), coreFree[core]...)
+		sort.Ints(cpus)
+		for _, cpu := range cpus {
+			order = append(order, cpu)
+			chosen[cpu] = true
+		}
+		if len(order) == want {
+			return order, true
+		}
+	}
+
+	// Not enough whole cores to satisfy the request: fall back to
+	// splitting SMT siblings from whatever free CPUs remain.
+	var remaining []int
+	for cpu := range nr.FreeCPUs {
+		if !chosen[cpu] {
+			remaining = append(remaining, cpu)
+		}
+	}
+	sort.Ints(remaining)
+	for _, cpu := range remaining {
+		if len(order) == want {
+			break
+		}
+		order = append(order, cpu)
+	}
+	if len(order) != want {
+		return nil, false
+	}
+	return order, true
+}
+
+// TopologyHint is the NUMA placement chosen for a pod's exclusive CPU
+// request: which socket it landed on, and which logical CPUs within it.
+type TopologyHint struct {
+	NUMAID int
+	CPUs   []int
+}
+
+// CPUAccumulator picks a cpuset for a pod's exclusive CPU request from a
+// node's per-NUMA free lists, preferring (1) the caller's preferred
+// socket, (2) the socket with the least free CPUs that can still satisfy
+// the request (to avoid fragmenting larger sockets), and within a socket
+// (3) whole physical cores before splitting SMT siblings.
+type CPUAccumulator struct {
+	numaNodes []NUMANodeResource
+}
+
+// NewCPUAccumulator builds a CPUAccumulator over the given NUMA nodes.
+func NewCPUAccumulator(numaNodes []NUMANodeResource) *CPUAccumulator {
+	return &CPUAccumulator{numaNodes: numaNodes}
+}
+
+// TakeExclusiveCPUs returns the chosen cpuset and the NUMA node it was
+// taken from, so a Reserve plugin can write the cpuset back as a pod
+// annotation for kubelet's CPUManager to honor.
+func (a *CPUAccumulator) TakeExclusiveCPUs(want int, preferredNUMA int) ([]int, int, error) {
+	order := make([]NUMANodeResource, len(a.numaNodes))
+	copy(order, a.numaNodes)
+	sort.SliceStable(order, func(i, j int) bool {
+		iPreferred := order[i].NUMAID == preferredNUMA
+		jPreferred := order[j].NUMAID == preferredNUMA
+		if iPreferred != jPreferred {
+			return iPreferred
+		}
+		return len(order[i].FreeCPUs) < len(order[j].FreeCPUs)
+	})
+
+	for _, n := range order {
+		if cpus, ok := n.takeExclusiveCPUs(want); ok {
+			return cpus, n.NUMAID, nil
+		}
+	}
+	return nil, -1, fmt.Errorf("no NUMA node has %d free exclusive CPUs available", want)
+}
+
+// NUMANodes returns the node's per-socket resource breakdown. Each
+// element is deep-copied via clone() so a caller mutating the returned
+// slice (or the maps hanging off an element) can't corrupt the cache's
+// own topology state.
+func (n *NodeInfo) NUMANodes() []NUMANodeResource {
+	if n == nil {
+		return nil
+	}
+	result := make([]NUMANodeResource, len(n.numaNodes))
+	for i := range n.numaNodes {
+		result[i] = n.numaNodes[i].clone()
+	}
+	return result
+}
+
+// SetNUMATopology replaces the node's per-socket topology, e.g. when
+// populating NodeInfo from the node's topology annotation/CRD.
+func (n *NodeInfo) SetNUMATopology(numaNodes []NUMANodeResource) {
+	n.numaNodes = numaNodes
+	n.generation++
+}
+
+// AddPodWithTopologyHint debits hint.CPUs and the pod's memory request
+// from the chosen NUMA node, and remembers the hint keyed by pod UID so
+// RemovePodWithTopologyHint reverses exactly this allocation.
+func (n *NodeInfo) AddPodWithTopologyHint(pod *v1.Pod, hint TopologyHint) error {
+	idx := n.numaIndex(hint.NUMAID)
+	if idx < 0 {
+		return fmt.Errorf("NUMA node %d not found on node %v", hint.NUMAID, n.node.Name)
+	}
+
+	socket := &n.numaNodes[idx]
+	for _, cpu := range hint.CPUs {
+		if !socket.FreeCPUs[cpu] {
+			return fmt.Errorf("cpu %d is not free on NUMA node %d of node %v", cpu, hint.NUMAID, n.node.Name)
+		}
+	}
+	for _, cpu := range hint.CPUs {
+		delete(socket.FreeCPUs, cpu)
+	}
+
+	res, _, _ := calculateResource(pod)
+	memReq := res.Memory
+	socket.MemoryUsed += memReq
+
+	n.podTopologyHints[pod.UID] = hint
+	n.generation++
+	return nil
+}
+
+// RemovePodWithTopologyHint reverses the allocation AddPodWithTopologyHint
+// made for pod, restoring its cpuset and memory share to the socket they
+// were taken from.
+func (n *NodeInfo) RemovePodWithTopologyHint(pod *v1.Pod) error {
+	hint, ok := n.podTopologyHints[pod.UID]
+	if !ok {
+		return nil
+	}
+
+	idx := n.numaIndex(hint.NUMAID)
+	if idx < 0 {
+		return fmt.Errorf("NUMA node %d not found on node %v", hint.NUMAID, n.node.Name)
+	}
+
+	socket := &n.numaNodes[idx]
+	for _, cpu := range hint.CPUs {
+		socket.FreeCPUs[cpu] = true
+	}
+
+	res, _, _ := calculateResource(pod)
+	memReq := res.Memory
+	socket.MemoryUsed -= memReq
+
+	delete(n.podTopologyHints, pod.UID)
+	n.generation++
+	return nil
+}
+
+func (n *NodeInfo) numaIndex(numaID int) int {
+	for i := range n.numaNodes {
+		if n.numaNodes[i].NUMAID == numaID {
+			return i
+		}
+	}
+	return -1
+}
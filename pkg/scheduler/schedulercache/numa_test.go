@@ -0,0 +1,175 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"sort"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func freeCPUSet(cpus ...int) map[int]bool {
+	free := make(map[int]bool, len(cpus))
+	for _, cpu := range cpus {
+		free[cpu] = true
+	}
+	return free
+}
+
+// fourCoreSocket is a NUMA node with 4 physical cores, 2 SMT threads each
+// (cpus 0-3 are core 0-3's first thread, 4-7 their second), all free.
+func fourCoreSocket() NUMANodeResource {
+	cpuToCore := map[int]int{}
+	for cpu := 0; cpu < 8; cpu++ {
+		cpuToCore[cpu] = cpu % 4
+	}
+	return NUMANodeResource{
+		NUMAID:         0,
+		ThreadsPerCore: 2,
+		CPUToCore:      cpuToCore,
+		FreeCPUs:       freeCPUSet(0, 1, 2, 3, 4, 5, 6, 7),
+	}
+}
+
+func TestTakeExclusiveCPUsWholeCoresBeforeSMTSplit(t *testing.T) {
+	socket := fourCoreSocket()
+
+	// 4 CPUs == 2 whole cores (core 0: cpus 0,4; core 1: cpus 1,5), so the
+	// whole-core path should satisfy the request without ever touching a
+	// half-free core.
+	got, ok := socket.takeExclusiveCPUs(4)
+	if !ok {
+		t.Fatalf("takeExclusiveCPUs(4) = _, false, want true")
+	}
+	sort.Ints(got)
+	want := []int{0, 1, 4, 5}
+	if !intSlicesEqual(got, want) {
+		t.Fatalf("takeExclusiveCPUs(4) = %v, want %v", got, want)
+	}
+}
+
+func TestTakeExclusiveCPUsFallsBackToSMTSplit(t *testing.T) {
+	socket := fourCoreSocket()
+
+	// 3 is not a multiple of ThreadsPerCore (2), so no combination of
+	// whole cores can satisfy it exactly and the fallback must split a
+	// core's siblings.
+	got, ok := socket.takeExclusiveCPUs(3)
+	if !ok {
+		t.Fatalf("takeExclusiveCPUs(3) = _, false, want true")
+	}
+	if len(got) != 3 {
+		t.Fatalf("takeExclusiveCPUs(3) returned %d cpus, want 3", len(got))
+	}
+	seen := map[int]bool{}
+	for _, cpu := range got {
+		if seen[cpu] {
+			t.Fatalf("takeExclusiveCPUs(3) = %v has duplicate cpu %d", got, cpu)
+		}
+		seen[cpu] = true
+	}
+}
+
+func TestTakeExclusiveCPUsNotEnoughFree(t *testing.T) {
+	socket := fourCoreSocket()
+	if _, ok := socket.takeExclusiveCPUs(9); ok {
+		t.Fatalf("takeExclusiveCPUs(9) = _, true, want false (only 8 cpus free)")
+	}
+}
+
+func intSlicesEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func memPod(uid types.UID, mem int64) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: string(uid), UID: uid},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{
+						v1.ResourceMemory: *resource.NewQuantity(mem, resource.BinarySI),
+					},
+				},
+			}},
+		},
+	}
+}
+
+// TestAddRemovePodWithTopologyHintSymmetry pins down that removing a pod's
+// topology hint restores the exact FreeCPUs/MemoryUsed state from before it
+// was added, across a couple of NUMA nodes.
+func TestAddRemovePodWithTopologyHintSymmetry(t *testing.T) {
+	n := NewNodeInfo()
+	socket1 := fourCoreSocket()
+	socket1.NUMAID = 1
+	n.SetNUMATopology([]NUMANodeResource{fourCoreSocket(), socket1})
+	before := n.NUMANodes()
+
+	pod := memPod("pod-1", 1<<20)
+	hint := TopologyHint{NUMAID: 1, CPUs: []int{1, 5}}
+	if err := n.AddPodWithTopologyHint(pod, hint); err != nil {
+		t.Fatalf("AddPodWithTopologyHint: %v", err)
+	}
+
+	afterAdd := n.NUMANodes()
+	socket := afterAdd[1]
+	if socket.FreeCPUs[1] || socket.FreeCPUs[5] {
+		t.Fatalf("socket 1 still shows cpus 1/5 free after AddPodWithTopologyHint: %+v", socket.FreeCPUs)
+	}
+	if socket.MemoryUsed != 1<<20 {
+		t.Fatalf("socket 1 MemoryUsed = %d, want %d", socket.MemoryUsed, int64(1<<20))
+	}
+
+	if err := n.RemovePodWithTopologyHint(pod); err != nil {
+		t.Fatalf("RemovePodWithTopologyHint: %v", err)
+	}
+
+	after := n.NUMANodes()
+	for i := range before {
+		if !freeCPUsEqual(before[i].FreeCPUs, after[i].FreeCPUs) {
+			t.Fatalf("NUMA node %d FreeCPUs = %v after add+remove, want %v", i, after[i].FreeCPUs, before[i].FreeCPUs)
+		}
+		if before[i].MemoryUsed != after[i].MemoryUsed {
+			t.Fatalf("NUMA node %d MemoryUsed = %d after add+remove, want %d", i, after[i].MemoryUsed, before[i].MemoryUsed)
+		}
+	}
+}
+
+func freeCPUsEqual(a, b map[int]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"k8s.io/api/core/v1"
+	qosutil "k8s.io/kubernetes/pkg/apis/core/v1/helper/qos"
+)
+
+const (
+	// ResourceReclaimedCPU and ResourceReclaimedMemory are Katalyst-style
+	// scalar resources a pod can request to be scheduled against the
+	// node's reclaimable tier instead of its strict Guaranteed/Burstable/
+	// BestEffort allocatable.
+	ResourceReclaimedCPU    v1.ResourceName = "kubernetes.io/reclaimed-cpu"
+	ResourceReclaimedMemory v1.ResourceName = "kubernetes.io/reclaimed-memory"
+)
+
+// RequestedResourceByQoS returns the aggregated resource request of pods
+// of the given QoS class on this node.
+func (n *NodeInfo) RequestedResourceByQoS(class v1.PodQOSClass) Resource {
+	if n == nil {
+		return emptyResource
+	}
+	r := n.requestedResourceByQoS[class]
+	if r == nil {
+		return emptyResource
+	}
+	return *r
+}
+
+// ReclaimableAllocatable returns the portion of the node's allocatable
+// capacity that reclaimable-tier pods may oversubscribe into: the node's
+// allocatable minus what Guaranteed, Burstable, and BestEffort pods have
+// already requested, minus what reclaimable-tier pods have already
+// requested of each other. Predicates can enforce a separate, looser
+// overcommit ratio against this instead of n.AllocatableResource().
+func (n *NodeInfo) ReclaimableAllocatable() Resource {
+	if n == nil {
+		return emptyResource
+	}
+	r := *n.allocatableResource
+	for _, class := range []v1.PodQOSClass{v1.PodQOSGuaranteed, v1.PodQOSBurstable, v1.PodQOSBestEffort} {
+		used := n.requestedResourceByQoS[class]
+		if used == nil {
+			continue
+		}
+		r.MilliCPU -= used.MilliCPU
+		r.Memory -= used.Memory
+	}
+	if used := n.reclaimableRequestedResource; used != nil {
+		r.MilliCPU -= used.MilliCPU
+		r.Memory -= used.Memory
+	}
+	return r
+}
+
+// isReclaimablePod reports whether every container in pod only requests
+// the reclaimed-cpu/reclaimed-memory scalars rather than native cpu/memory,
+// i.e. the pod is meant to run in the node's reclaimable tier.
+func isReclaimablePod(pod *v1.Pod) bool {
+	reclaimable := false
+	for i := range pod.Spec.Containers {
+		for rName := range pod.Spec.Containers[i].Resources.Requests {
+			switch rName {
+			case ResourceReclaimedCPU, ResourceReclaimedMemory:
+				reclaimable = true
+			case v1.ResourceCPU, v1.ResourceMemory:
+				return false
+			}
+		}
+	}
+	return reclaimable
+}
+
+// reclaimedRequest returns res's reclaimed-cpu/reclaimed-memory scalars,
+// converted into the same MilliCPU/Memory units the rest of Resource
+// uses. res.MilliCPU/res.Memory are always 0 for a reclaimable pod, since
+// calculateResource only fills those from native cpu/memory requests and
+// a reclaimable pod requests the kubernetes.io/reclaimed-* scalars
+// instead - those land in res.ScalarResources.
+func reclaimedRequest(res Resource) (milliCPU, memory int64) {
+	milliCPU = res.ScalarResources[ResourceReclaimedCPU] * 1000
+	memory = res.ScalarResources[ResourceReclaimedMemory]
+	return
+}
+
+// addToQoS credits res, the resource a pod just added to the node,
+// against the pod's QoS-class bucket and, if the pod is reclaimable,
+// against the reclaimable bucket as well.
+func (n *NodeInfo) addToQoS(pod *v1.Pod, res Resource) {
+	class := qosutil.GetPodQOS(pod)
+	bucket, ok := n.requestedResourceByQoS[class]
+	if !ok {
+		bucket = &Resource{}
+		n.requestedResourceByQoS[class] = bucket
+	}
+	bucket.MilliCPU += res.MilliCPU
+	bucket.Memory += res.Memory
+
+	if isReclaimablePod(pod) {
+		milliCPU, memory := reclaimedRequest(res)
+		n.reclaimableRequestedResource.MilliCPU += milliCPU
+		n.reclaimableRequestedResource.Memory += memory
+	}
+}
+
+// subtractFromQoS reverses addToQoS for a pod being removed from the node.
+func (n *NodeInfo) subtractFromQoS(pod *v1.Pod, res Resource) {
+	class := qosutil.GetPodQOS(pod)
+	if bucket, ok := n.requestedResourceByQoS[class]; ok {
+		bucket.MilliCPU -= res.MilliCPU
+		bucket.Memory -= res.Memory
+	}
+
+	if isReclaimablePod(pod) {
+		milliCPU, memory := reclaimedRequest(res)
+		n.reclaimableRequestedResource.MilliCPU -= milliCPU
+		n.reclaimableRequestedResource.Memory -= memory
+	}
+}
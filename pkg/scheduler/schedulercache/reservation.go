@@ -0,0 +1,350 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Reservation is a first-class scheduler API object representing a
+// pre-allocated slice of a node's resources that only pods matching
+// AllowedOwners may consume. Unlike the legacy pod.Spec.ResourceReservation
+// field, a Reservation is created, nominated, and garbage-collected
+// independently of any single pod, which lets it outlive the pod that
+// requested it (e.g. across a voluntary eviction or a rolling update).
+type Reservation struct {
+	Name      string
+	Namespace string
+	UID       types.UID
+
+	// NodeName is the node this reservation carves capacity out of.
+	NodeName string
+
+	// OwnerReference identifies the object (Pod, Deployment, controller,
+	// etc.) this reservation was created on behalf of.
+	OwnerReference *metav1.OwnerReference
+
+	// AllowedOwners restricts which pods may consume this reservation's
+	// remaining capacity; a pod must match at least one selector to be
+	// accounted against the reservation instead of the node's general
+	// allocatable.
+	AllowedOwners []metav1.LabelSelector
+
+	// ExpiresAt bounds how long a reservation is kept around before the
+	// cache expires it, whether or not pods have consumed from it; the
+	// zero value means the reservation never expires on its own.
+	ExpiresAt time.Time
+
+	// Allocatable is the total capacity carved out for this reservation.
+	Allocatable Resource
+	// Allocated is the portion of Allocatable currently consumed by
+	// matching pods.
+	Allocated Resource
+}
+
+func reservationKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+// Matches reports whether pod is allowed to consume this reservation's
+// remaining capacity, based on AllowedOwners.
+func (r *Reservation) Matches(pod *v1.Pod) bool {
+	if len(r.AllowedOwners) == 0 {
+		return false
+	}
+	for i := range r.AllowedOwners {
+		selector, err := metav1.LabelSelectorAsSelector(&r.AllowedOwners[i])
+		if err != nil {
+			continue
+		}
+		if selector.Matches(labels.Set(pod.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remaining returns the unconsumed portion of the reservation, across
+// MilliCPU/Memory and every scalar resource (GPU memory, hugepages, ...)
+// the reservation carved out.
+func (r *Reservation) Remaining() Resource {
+	remaining := *r.Allocatable.Clone()
+	remaining.RemoveResource(&r.Allocated)
+	return remaining
+}
+
+// Clone returns a deep copy of the reservation, safe for a caller to hold
+// across a scheduling cycle without racing the cache's own bookkeeping.
+func (r *Reservation) Clone() *Reservation {
+	clone := *r
+	if r.AllowedOwners != nil {
+		clone.AllowedOwners = append([]metav1.LabelSelector(nil), r.AllowedOwners...)
+	}
+	if r.Allocatable.ScalarResources != nil {
+		clone.Allocatable = *r.Allocatable.Clone()
+	}
+	if r.Allocated.ScalarResources != nil {
+		clone.Allocated = *r.Allocated.Clone()
+	}
+	return &clone
+}
+
+// registerReservation records that reservation has carved out part of
+// this node's allocatable capacity, making its unconsumed share
+// unavailable to pods that don't match AllowedOwners.
+func (n *NodeInfo) registerReservation(reservation *Reservation) {
+	key := reservationKey(reservation.Namespace, reservation.Name)
+	n.reservations[key] = reservation
+	n.generation++
+}
+
+// unregisterReservation reverses registerReservation.
+func (n *NodeInfo) unregisterReservation(namespace, name string) {
+	delete(n.reservations, reservationKey(namespace, name))
+	n.generation++
+}
+
+// ReservedAllocatable returns the portion of the node's allocatable
+// capacity carved out by Reservations but not yet consumed by a matching
+// pod, so predicates can narrow a non-matching pod's view of available
+// capacity the same way ReclaimableAllocatable narrows it for the
+// reclaimable tier.
+func (n *NodeInfo) ReservedAllocatable() Resource {
+	reserved := Resource{}
+	for _, r := range n.reservations {
+		remaining := r.Remaining()
+		reserved.AddResource(&remaining)
+	}
+	return reserved
+}
+
+// consumeReservation debits res from a Reservation on this node that pod
+// matches and that still has room for it (reservations are tried in no
+// defined order, so with several candidates any one may be picked), recording the match
+// so releaseReservation can reverse exactly this debit. A pod that
+// doesn't match any reservation, or doesn't fit any matching one, is
+// left to consume from the node's general allocatable as usual. It
+// reports whether a reservation was actually debited, so the caller can
+// exclude res from the node's general requestedResource instead of
+// counting it against both.
+func (n *NodeInfo) consumeReservation(pod *v1.Pod, res Resource) bool {
+	key, err := getPodKey(pod)
+	if err != nil {
+		return false
+	}
+	for rKey, r := range n.reservations {
+		if !r.Matches(pod) {
+			continue
+		}
+		remaining := r.Remaining()
+		if remaining.MilliCPU < res.MilliCPU || remaining.Memory < res.Memory {
+			continue
+		}
+		fits := true
+		for rName, rQuant := range res.ScalarResources {
+			if remaining.ScalarResources[rName] < rQuant {
+				fits = false
+				break
+			}
+		}
+		if !fits {
+			continue
+		}
+		r.Allocated.AddResource(&res)
+		n.podReservations[key] = rKey
+		return true
+	}
+	return false
+}
+
+// releaseReservation reverses consumeReservation for the pod identified
+// by key, crediting res back to the reservation it was debited against,
+// if any.
+func (n *NodeInfo) releaseReservation(key string, res Resource) {
+	rKey, ok := n.podReservations[key]
+	if !ok {
+		return
+	}
+	delete(n.podReservations, key)
+	if r, ok := n.reservations[rKey]; ok {
+		r.Allocated.RemoveResource(&res)
+	}
+}
+
+// nodeForReservation returns the NodeInfo reservation.NodeName targets,
+// creating an empty one if the node hasn't been observed yet - mirroring
+// the create-if-missing pattern AddPod/AddNode already use, since
+// Reservation events and Node events arrive on independent watches.
+func (cache *schedulerCache) nodeForReservation(nodeName string) *NodeInfo {
+	n, ok := cache.nodes[nodeName]
+	if !ok {
+		n = NewNodeInfo()
+		cache.nodes[nodeName] = n
+	}
+	return n
+}
+
+func (cache *schedulerCache) AddReservation(reservation *Reservation) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := reservationKey(reservation.Namespace, reservation.Name)
+	if cache.assumedReservations[key] {
+		// Confirms a previously assumed reservation.
+		delete(cache.assumedReservations, key)
+		cache.reservations[key] = reservation
+		cache.nodeForReservation(reservation.NodeName).registerReservation(reservation)
+		return nil
+	}
+	if _, ok := cache.reservations[key]; ok {
+		return fmt.Errorf("reservation %v is already present in cache", key)
+	}
+	cache.reservations[key] = reservation
+	cache.nodeForReservation(reservation.NodeName).registerReservation(reservation)
+	return nil
+}
+
+func (cache *schedulerCache) UpdateReservation(oldReservation, newReservation *Reservation) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := reservationKey(oldReservation.Namespace, oldReservation.Name)
+	if _, ok := cache.reservations[key]; !ok {
+		return fmt.Errorf("reservation %v is not present in cache", key)
+	}
+	if n, ok := cache.nodes[oldReservation.NodeName]; ok {
+		n.unregisterReservation(oldReservation.Namespace, oldReservation.Name)
+	}
+	delete(cache.reservations, key)
+	cache.reservations[reservationKey(newReservation.Namespace, newReservation.Name)] = newReservation
+	cache.nodeForReservation(newReservation.NodeName).registerReservation(newReservation)
+	return nil
+}
+
+func (cache *schedulerCache) RemoveReservation(reservation *Reservation) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := reservationKey(reservation.Namespace, reservation.Name)
+	if _, ok := cache.reservations[key]; !ok {
+		return fmt.Errorf("reservation %v is not present in cache", key)
+	}
+	if n, ok := cache.nodes[reservation.NodeName]; ok {
+		n.unregisterReservation(reservation.Namespace, reservation.Name)
+	}
+	delete(cache.reservations, key)
+	delete(cache.assumedReservations, key)
+	return nil
+}
+
+func (cache *schedulerCache) AssumeReservation(reservation *Reservation) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	key := reservationKey(reservation.Namespace, reservation.Name)
+	if _, ok := cache.reservations[key]; ok {
+		return fmt.Errorf("reservation %v is already in the cache, so can't be assumed", key)
+	}
+	cache.reservations[key] = reservation
+	cache.assumedReservations[key] = true
+	cache.nodeForReservation(reservation.NodeName).registerReservation(reservation)
+	return nil
+}
+
+// cleanupExpiredReservations runs periodically alongside
+// cleanupExpiredAssumedPods to enforce the ExpiresAt a Reservation was
+// created with; without it, ExpiresAt was stored but never acted on.
+func (cache *schedulerCache) cleanupExpiredReservations() {
+	cache.cleanupReservations(time.Now())
+}
+
+// cleanupReservations exists for making tests deterministic by taking
+// time as an input argument, mirroring cleanupAssumedPods.
+func (cache *schedulerCache) cleanupReservations(now time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for key, r := range cache.reservations {
+		if r.ExpiresAt.IsZero() || now.Before(r.ExpiresAt) {
+			continue
+		}
+		if n, ok := cache.nodes[r.NodeName]; ok {
+			n.unregisterReservation(r.Namespace, r.Name)
+		}
+		delete(cache.reservations, key)
+		delete(cache.assumedReservations, key)
+	}
+}
+
+func (cache *schedulerCache) GetReservation(namespace, name string) (*Reservation, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	r, ok := cache.reservations[reservationKey(namespace, name)]
+	return r, ok
+}
+
+// ReservationNominator is consulted by scheduling plugins during
+// Filter/Reserve/PostFilter to remember which reservation a pod is
+// tentatively bound to before the scheduler commits to a final decision,
+// mirroring how the generic scheduler nominates a node for a preempting
+// pod.
+type ReservationNominator interface {
+	// NominateReservationForPod records that pod should be considered
+	// matched against reservation for the remainder of this scheduling
+	// cycle.
+	NominateReservationForPod(pod *v1.Pod, reservation *Reservation)
+	// RemoveNominatedReservations clears any reservation nomination
+	// recorded for pod.
+	RemoveNominatedReservations(pod *v1.Pod)
+	// DeleteNominatedReservationIfExists is a best-effort variant of
+	// RemoveNominatedReservations that callers can use without first
+	// checking whether a nomination exists.
+	DeleteNominatedReservationIfExists(pod *v1.Pod)
+}
+
+func (cache *schedulerCache) NominateReservationForPod(pod *v1.Pod, reservation *Reservation) {
+	key, err := getPodKey(pod)
+	if err != nil {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.nominatedReservations[key] = reservation
+}
+
+func (cache *schedulerCache) RemoveNominatedReservations(pod *v1.Pod) {
+	cache.DeleteNominatedReservationIfExists(pod)
+}
+
+func (cache *schedulerCache) DeleteNominatedReservationIfExists(pod *v1.Pod) {
+	key, err := getPodKey(pod)
+	if err != nil {
+		return
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.nominatedReservations, key)
+}
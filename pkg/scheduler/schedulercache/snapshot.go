@@ -0,0 +1,190 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"github.com/golang/glog"
+)
+
+// Snapshot is an immutable-for-the-duration-of-a-scheduling-cycle view of
+// all NodeInfos in the cache. Plugins read node data through a Snapshot
+// for the whole cycle instead of each asking the cache for its own clone,
+// and UpdateSnapshot only clones the NodeInfos that mutated since the
+// snapshot was last refreshed.
+type Snapshot struct {
+	nodeInfoMap  map[string]*NodeInfo
+	nodeInfoList []*NodeInfo
+	generation   int64
+}
+
+// NewSnapshot returns an empty Snapshot ready to be passed to
+// Cache.UpdateSnapshot.
+func NewSnapshot() *Snapshot {
+	return &Snapshot{
+		nodeInfoMap: make(map[string]*NodeInfo),
+	}
+}
+
+// NodeInfoMap returns the snapshot's NodeInfos keyed by node name.
+func (s *Snapshot) NodeInfoMap() map[string]*NodeInfo {
+	return s.nodeInfoMap
+}
+
+// NodeInfoList returns the snapshot's NodeInfos.
+func (s *Snapshot) NodeInfoList() []*NodeInfo {
+	return s.nodeInfoList
+}
+
+// nodeInfoListItem is a node in the cache's doubly linked list of
+// NodeInfos, ordered by most-recent mutation.
+type nodeInfoListItem struct {
+	info *NodeInfo
+	next *nodeInfoListItem
+	prev *nodeInfoListItem
+}
+
+// touchNode records that the NodeInfo for name just mutated, moving it to
+// the head of the recency-ordered list (inserting it if this is the
+// first time name has been touched).
+func (cache *schedulerCache) touchNode(name string) {
+	info, ok := cache.nodes[name]
+	if !ok {
+		return
+	}
+
+	item, ok := cache.nodeList[name]
+	if !ok {
+		item = &nodeInfoListItem{info: info}
+		cache.nodeList[name] = item
+		item.next = cache.headNode
+		if cache.headNode != nil {
+			cache.headNode.prev = item
+		}
+		cache.headNode = item
+		return
+	}
+
+	item.info = info
+	cache.moveNodeInfoToHead(name)
+}
+
+func (cache *schedulerCache) moveNodeInfoToHead(name string) {
+	item, ok := cache.nodeList[name]
+	if !ok {
+		glog.Errorf("no NodeInfo with name %v found in the cache's node list", name)
+		return
+	}
+	if item == cache.headNode {
+		return
+	}
+
+	if item.prev != nil {
+		item.prev.next = item.next
+	}
+	if item.next != nil {
+		item.next.prev = item.prev
+	}
+
+	item.prev = nil
+	item.next = cache.headNode
+	if cache.headNode != nil {
+		cache.headNode.prev = item
+	}
+	cache.headNode = item
+}
+
+func (cache *schedulerCache) removeNodeInfoFromList(name string) {
+	item, ok := cache.nodeList[name]
+	if !ok {
+		glog.Errorf("no NodeInfo with name %v found in the cache's node list", name)
+		return
+	}
+
+	if item.prev != nil {
+		item.prev.next = item.next
+	}
+	if item.next != nil {
+		item.next.prev = item.prev
+	}
+	if item == cache.headNode {
+		cache.headNode = item.next
+	}
+	delete(cache.nodeList, name)
+}
+
+// UpdateSnapshot walks the recency-ordered node list from the head,
+// cloning only the NodeInfos that snap doesn't hold yet or whose
+// generation differs from snap's copy of that node, and stops as soon as
+// it reaches one whose copy is current - since the list is ordered by
+// mutation recency, everything after that point is unchanged too. This
+// makes a snapshot refresh O(changed nodes) instead of O(all nodes).
+func (cache *schedulerCache) UpdateSnapshot(snap *Snapshot) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if snap.nodeInfoMap == nil {
+		snap.nodeInfoMap = make(map[string]*NodeInfo)
+	}
+
+	updateAllLists := false
+	for item := cache.headNode; item != nil; item = item.next {
+		node := item.info.Node()
+		if node == nil {
+			continue
+		}
+		existing, ok := snap.nodeInfoMap[node.Name]
+		if ok && existing.generation == item.info.generation {
+			break
+		}
+		clone := item.info.Clone()
+		if ok {
+			// Copy into the existing *NodeInfo rather than replacing the
+			// map entry, so nodeInfoList - which holds this same pointer -
+			// picks up the update too without needing a full rebuild.
+			*existing = *clone
+		} else {
+			snap.nodeInfoMap[node.Name] = clone
+			updateAllLists = true
+		}
+	}
+
+	if cache.headNode != nil {
+		snap.generation = cache.headNode.info.generation
+	}
+
+	if len(snap.nodeInfoMap) > len(cache.nodes) {
+		for name := range snap.nodeInfoMap {
+			if _, ok := cache.nodes[name]; !ok {
+				delete(snap.nodeInfoMap, name)
+			}
+		}
+		updateAllLists = true
+	}
+
+	if updateAllLists {
+		snap.nodeInfoList = make([]*NodeInfo, 0, len(snap.nodeInfoMap))
+		for item := cache.headNode; item != nil; item = item.next {
+			if node := item.info.Node(); node != nil {
+				if info, ok := snap.nodeInfoMap[node.Name]; ok {
+					snap.nodeInfoList = append(snap.nodeInfoList, info)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2015 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schedulercache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func benchNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Allocatable: v1.ResourceList{
+				v1.ResourceCPU:    *resource.NewQuantity(4, resource.DecimalSI),
+				v1.ResourceMemory: *resource.NewQuantity(16<<30, resource.BinarySI),
+			},
+		},
+	}
+}
+
+// BenchmarkUpdateSnapshotLowChurn simulates a 5k-node cluster where only a
+// handful of nodes mutate between scheduling cycles - the case the
+// generation-diff walk in UpdateSnapshot is meant to win on. Each
+// iteration should cost roughly O(churned nodes), not O(cluster size).
+func BenchmarkUpdateSnapshotLowChurn(b *testing.B) {
+	const (
+		numNodes   = 5000
+		numChurned = 5
+	)
+
+	cache := newSchedulerCache(30*time.Second, 10*time.Second, make(chan struct{}))
+	for i := 0; i < numNodes; i++ {
+		if err := cache.AddNode(benchNode(fmt.Sprintf("node-%d", i))); err != nil {
+			b.Fatalf("AddNode: %v", err)
+		}
+	}
+
+	snap := NewSnapshot()
+	if err := cache.UpdateSnapshot(snap); err != nil {
+		b.Fatalf("initial UpdateSnapshot: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < numChurned; j++ {
+			node := benchNode(fmt.Sprintf("node-%d", j))
+			if err := cache.UpdateNode(node, node); err != nil {
+				b.Fatalf("UpdateNode: %v", err)
+			}
+		}
+		if err := cache.UpdateSnapshot(snap); err != nil {
+			b.Fatalf("UpdateSnapshot: %v", err)
+		}
+	}
+}
+
+// BenchmarkUpdateSnapshotFullClone is the counterpoint: every node mutates
+// every cycle, so UpdateSnapshot clones the whole cluster and the
+// generation-diff walk can't save anything. Comparing the two benchmarks
+// is what demonstrates the low-churn win, not either number alone.
+func BenchmarkUpdateSnapshotFullClone(b *testing.B) {
+	const numNodes = 5000
+
+	cache := newSchedulerCache(30*time.Second, 10*time.Second, make(chan struct{}))
+	for i := 0; i < numNodes; i++ {
+		if err := cache.AddNode(benchNode(fmt.Sprintf("node-%d", i))); err != nil {
+			b.Fatalf("AddNode: %v", err)
+		}
+	}
+
+	snap := NewSnapshot()
+	if err := cache.UpdateSnapshot(snap); err != nil {
+		b.Fatalf("initial UpdateSnapshot: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < numNodes; j++ {
+			node := benchNode(fmt.Sprintf("node-%d", j))
+			if err := cache.UpdateNode(node, node); err != nil {
+				b.Fatalf("UpdateNode: %v", err)
+			}
+		}
+		if err := cache.UpdateSnapshot(snap); err != nil {
+			b.Fatalf("UpdateSnapshot: %v", err)
+		}
+	}
+}